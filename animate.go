@@ -0,0 +1,66 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/png"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+)
+
+// encodeAnimatedWebP muxes frames into an animated WebP via img2webp, part
+// of the libwebp tool suite. chai2010/webp only wraps static single-frame
+// libwebp encoding and has no animation-mux API, so multi-frame output has
+// to shell out rather than go through encodeWebPBytes's normal path.
+func encodeAnimatedWebP(decoded *decodedImage, quality int, lossless bool) ([]byte, error) {
+	if _, err := exec.LookPath("img2webp"); err != nil {
+		return nil, fmt.Errorf("img2webp not found in PATH (required for animated WebP output): %v", err)
+	}
+
+	tmpDir, err := os.MkdirTemp("", "img-opt-anim-*")
+	if err != nil {
+		return nil, fmt.Errorf("create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	args := []string{"-loop", strconv.Itoa(decoded.LoopCount)}
+	if lossless {
+		args = append(args, "-lossless")
+	} else {
+		args = append(args, "-q", strconv.Itoa(quality))
+	}
+
+	for i, frame := range decoded.Frames {
+		framePath := filepath.Join(tmpDir, fmt.Sprintf("frame-%04d.png", i))
+		if err := writePNG(framePath, frame); err != nil {
+			return nil, fmt.Errorf("write frame %d: %v", i, err)
+		}
+
+		delayMS := 100 * 10 // fallback for malformed GIFs with a zero delay
+		if i < len(decoded.Delays) && decoded.Delays[i] > 0 {
+			delayMS = decoded.Delays[i] * 10
+		}
+		args = append(args, "-d", strconv.Itoa(delayMS), framePath)
+	}
+
+	outPath := filepath.Join(tmpDir, "out.webp")
+	args = append(args, "-o", outPath)
+
+	cmd := exec.Command("img2webp", args...)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return nil, fmt.Errorf("img2webp: %v: %s", err, out)
+	}
+
+	return os.ReadFile(outPath)
+}
+
+func writePNG(path string, img image.Image) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return png.Encode(f, img)
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// cache is a persistent on-disk store of already-encoded WebP output, keyed
+// by the hash of the source bytes plus the encode options that affect the
+// result (quality, lossless, format). A hit lets a re-run of the tool over
+// the same directory or URLs skip re-encoding entirely.
+type cache struct {
+	dir    string
+	maxAge time.Duration // -1 means never expire; dir == "" means disabled
+}
+
+// newCache prepares the cache directory. maxAgeSeconds of 0 disables the
+// cache outright; -1 (or any negative value) means entries never expire.
+// An empty dir defaults to ~/.cache/img-opt.
+func newCache(dir string, maxAgeSeconds int) (*cache, error) {
+	if maxAgeSeconds == 0 {
+		return &cache{}, nil
+	}
+
+	if dir == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil, err
+		}
+		dir = filepath.Join(home, ".cache", "img-opt")
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+
+	maxAge := time.Duration(-1)
+	if maxAgeSeconds > 0 {
+		maxAge = time.Duration(maxAgeSeconds) * time.Second
+	}
+	return &cache{dir: dir, maxAge: maxAge}, nil
+}
+
+func (c *cache) enabled() bool { return c.dir != "" }
+
+// key derives the cache key for a source image plus the options that
+// affect its encoded output.
+func (c *cache) key(source []byte, quality int, lossless bool, format string) string {
+	sum := sha256.Sum256(source)
+	return fmt.Sprintf("%s-q%d-l%t-%s", hex.EncodeToString(sum[:]), quality, lossless, format)
+}
+
+func (c *cache) entryPath(key string) string {
+	return filepath.Join(c.dir, key+".webp")
+}
+
+// get returns the cached WebP bytes for key, or ok=false on a miss or an
+// expired entry.
+func (c *cache) get(key string) (data []byte, ok bool) {
+	if !c.enabled() {
+		return nil, false
+	}
+	p := c.entryPath(key)
+	info, err := os.Stat(p)
+	if err != nil {
+		return nil, false
+	}
+	if c.maxAge >= 0 && time.Since(info.ModTime()) > c.maxAge {
+		return nil, false
+	}
+	data, err = os.ReadFile(p)
+	if err != nil {
+		return nil, false
+	}
+	return data, true
+}
+
+// put stores encoded WebP bytes under key.
+func (c *cache) put(key string, data []byte) {
+	if !c.enabled() {
+		return
+	}
+	_ = os.WriteFile(c.entryPath(key), data, 0o644)
+}
+
+// urlMeta records the conditional-GET validators and resulting cache key
+// for a previously fetched URL, so the next run can issue an
+// If-None-Match/If-Modified-Since request and skip the download entirely
+// when the remote image hasn't changed.
+type urlMeta struct {
+	ETag         string `json:"etag"`
+	LastModified string `json:"last_modified"`
+	ContentKey   string `json:"content_key"`
+}
+
+func (c *cache) urlMetaPath(u string) string {
+	sum := sha256.Sum256([]byte(u))
+	return filepath.Join(c.dir, "url-"+hex.EncodeToString(sum[:])+".json")
+}
+
+func (c *cache) loadURLMeta(u string) (urlMeta, bool) {
+	if !c.enabled() {
+		return urlMeta{}, false
+	}
+	data, err := os.ReadFile(c.urlMetaPath(u))
+	if err != nil {
+		return urlMeta{}, false
+	}
+	var meta urlMeta
+	if err := json.Unmarshal(data, &meta); err != nil {
+		return urlMeta{}, false
+	}
+	return meta, true
+}
+
+func (c *cache) saveURLMeta(u string, meta urlMeta) {
+	if !c.enabled() {
+		return
+	}
+	data, err := json.Marshal(meta)
+	if err != nil {
+		return
+	}
+	_ = os.WriteFile(c.urlMetaPath(u), data, 0o644)
+}
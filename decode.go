@@ -0,0 +1,216 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/draw"
+	"image/gif"
+
+	"github.com/gen2brain/avif"
+	heif "github.com/strukturag/libheif-go"
+	"golang.org/x/image/bmp"
+	"golang.org/x/image/tiff"
+)
+
+// decodeHEIC decodes the primary image out of a HEIC/HEIF container using
+// libheif-go's context/handle API (there is no one-shot Decode(io.Reader)
+// helper in this binding). Pinned against libheif-go v1.17.x, which is the
+// first tag whose Handle.DecodeImage signature matches the one used below;
+// bump this comment if the vendored version changes.
+func decodeHEIC(src []byte) (image.Image, error) {
+	ctx, err := heif.NewContext()
+	if err != nil {
+		return nil, fmt.Errorf("new heif context: %v", err)
+	}
+	if err := ctx.ReadFromMemory(src); err != nil {
+		return nil, fmt.Errorf("read heif data: %v", err)
+	}
+	handle, err := ctx.GetPrimaryImageHandle()
+	if err != nil {
+		return nil, fmt.Errorf("get primary image handle: %v", err)
+	}
+	img, err := handle.DecodeImage(heif.ColorspaceUndefined, heif.ChromaUndefined, nil)
+	if err != nil {
+		return nil, fmt.Errorf("decode image handle: %v", err)
+	}
+	return img.GetImage()
+}
+
+// sniffLen mirrors the header window http.DetectContentType inspects.
+const sniffLen = 512
+
+// decodedImage holds every frame decoded from a source image plus the
+// animation metadata needed to re-encode it as WebP. Single-frame formats
+// populate Frames with one entry and leave Delays/LoopCount at their zero
+// value.
+type decodedImage struct {
+	Frames    []image.Image
+	Delays    []int // per-frame delay in 100ths of a second, gif-style
+	LoopCount int
+	Format    string
+}
+
+// headerOf returns the leading sniffLen bytes of src, or all of src if it's
+// shorter, for callers that only need to sniff and not decode.
+func headerOf(src []byte) []byte {
+	if len(src) > sniffLen {
+		return src[:sniffLen]
+	}
+	return src
+}
+
+// sniffFormat identifies an image format from its leading bytes, the same
+// magic-number approach http.DetectContentType uses, extended to cover the
+// containers the stdlib decoders don't register.
+func sniffFormat(header []byte) string {
+	switch {
+	case len(header) >= 12 && bytes.Equal(header[4:8], []byte("ftyp")):
+		switch string(header[8:12]) {
+		case "heic", "heix", "hevc", "heim", "heis", "hevm", "hevs", "mif1", "msf1":
+			return "heic"
+		case "avif", "avis":
+			return "avif"
+		}
+	case len(header) >= 4 && bytes.Equal(header[:4], []byte{0x49, 0x49, 0x2A, 0x00}):
+		return "tiff"
+	case len(header) >= 4 && bytes.Equal(header[:4], []byte{0x4D, 0x4D, 0x00, 0x2A}):
+		return "tiff"
+	case len(header) >= 2 && header[0] == 'B' && header[1] == 'M':
+		return "bmp"
+	}
+
+	if _, format, err := image.DecodeConfig(bytes.NewReader(header)); err == nil {
+		return format
+	}
+	return ""
+}
+
+// sniffDimensions reads just enough of src to report its pixel dimensions
+// without decoding any pixels, for the cache-hit path where a full decodeAll
+// would otherwise throw away the expensive part of the pipeline. heic and
+// avif have no equivalent cheap header-only path through their decode
+// libraries, so they report zero dimensions rather than falling back to a
+// full decode.
+func sniffDimensions(format string, src []byte) (width, height int, err error) {
+	switch format {
+	case "heic", "avif":
+		return 0, 0, nil
+	case "tiff":
+		cfg, err := tiff.DecodeConfig(bytes.NewReader(src))
+		if err != nil {
+			return 0, 0, err
+		}
+		return cfg.Width, cfg.Height, nil
+	case "bmp":
+		cfg, err := bmp.DecodeConfig(bytes.NewReader(src))
+		if err != nil {
+			return 0, 0, err
+		}
+		return cfg.Width, cfg.Height, nil
+	default:
+		cfg, _, err := image.DecodeConfig(bytes.NewReader(src))
+		if err != nil {
+			return 0, 0, err
+		}
+		return cfg.Width, cfg.Height, nil
+	}
+}
+
+// compositeGIFFrames renders gif.DecodeAll's raw frames onto full
+// logical-screen-sized canvases, honoring per-frame disposal. Most
+// frame-diff-optimized GIFs (the common case out of ffmpeg/Photoshop/
+// ImageMagick) decode to *image.Paletted frames smaller than, and offset
+// within, the logical screen; handing those straight to a PNG/WebP encoder
+// drops the offset and encodes the sub-rectangle as if it were the whole
+// frame. This walks the same accumulate-then-dispose loop a GIF player
+// does so every returned frame is already a complete, correctly composited
+// picture.
+func compositeGIFFrames(g *gif.GIF) []image.Image {
+	canvas := image.NewRGBA(image.Rect(0, 0, g.Config.Width, g.Config.Height))
+	frames := make([]image.Image, len(g.Image))
+
+	for i, frame := range g.Image {
+		disposal := byte(0)
+		if i < len(g.Disposal) {
+			disposal = g.Disposal[i]
+		}
+
+		var previous *image.RGBA
+		if disposal == gif.DisposalPrevious {
+			previous = image.NewRGBA(canvas.Bounds())
+			draw.Draw(previous, canvas.Bounds(), canvas, image.Point{}, draw.Src)
+		}
+
+		draw.Draw(canvas, frame.Bounds(), frame, frame.Bounds().Min, draw.Over)
+
+		composited := image.NewRGBA(canvas.Bounds())
+		draw.Draw(composited, canvas.Bounds(), canvas, image.Point{}, draw.Src)
+		frames[i] = composited
+
+		switch disposal {
+		case gif.DisposalBackground:
+			draw.Draw(canvas, frame.Bounds(), image.Transparent, image.Point{}, draw.Src)
+		case gif.DisposalPrevious:
+			canvas = previous
+		}
+	}
+
+	return frames
+}
+
+// decodeAll decodes src into one or more frames, dispatching on the sniffed
+// format rather than the stdlib's four registered decoders. Multi-frame GIFs
+// come back with one image.Image per frame plus their delays; everything
+// else comes back as a single frame.
+func decodeAll(src []byte) (*decodedImage, error) {
+	format := sniffFormat(headerOf(src))
+
+	switch format {
+	case "heic":
+		img, err := decodeHEIC(src)
+		if err != nil {
+			return nil, fmt.Errorf("decode heic: %v", err)
+		}
+		return &decodedImage{Frames: []image.Image{img}, Format: format}, nil
+
+	case "avif":
+		img, err := avif.Decode(bytes.NewReader(src))
+		if err != nil {
+			return nil, fmt.Errorf("decode avif: %v", err)
+		}
+		return &decodedImage{Frames: []image.Image{img}, Format: format}, nil
+
+	case "tiff":
+		img, err := tiff.Decode(bytes.NewReader(src))
+		if err != nil {
+			return nil, fmt.Errorf("decode tiff: %v", err)
+		}
+		return &decodedImage{Frames: []image.Image{img}, Format: format}, nil
+
+	case "bmp":
+		img, err := bmp.Decode(bytes.NewReader(src))
+		if err != nil {
+			return nil, fmt.Errorf("decode bmp: %v", err)
+		}
+		return &decodedImage{Frames: []image.Image{img}, Format: format}, nil
+
+	case "gif":
+		g, err := gif.DecodeAll(bytes.NewReader(src))
+		if err != nil {
+			return nil, fmt.Errorf("decode gif: %v", err)
+		}
+		frames := compositeGIFFrames(g)
+		return &decodedImage{Frames: frames, Delays: g.Delay, LoopCount: g.LoopCount, Format: format}, nil
+
+	default:
+		img, decFormat, err := image.Decode(bytes.NewReader(src))
+		if err != nil {
+			return nil, fmt.Errorf("decode: %v", err)
+		}
+		if format == "" {
+			format = decFormat
+		}
+		return &decodedImage{Frames: []image.Image{img}, Format: format}, nil
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// shardCount is the number of first-byte hex shards under content/, one per
+// possible value of the hash's leading byte (0x00-0xff).
+const shardCount = 256
+
+// prepareOutputDirs creates outDir and, for layout "content", pre-creates
+// all 256 content/<xx> shard directories plus the date/ root up front so
+// concurrent workers never race on MkdirAll for a shard while writing. The
+// date/YYYY/MM/DD directories below date/ are created by writeOutput as
+// needed.
+func prepareOutputDirs(outDir, layout string) error {
+	if err := os.MkdirAll(outDir, 0o755); err != nil {
+		return err
+	}
+	if layout != "content" {
+		return nil
+	}
+	for i := 0; i < shardCount; i++ {
+		shard := fmt.Sprintf("%02x", i)
+		if err := os.MkdirAll(filepath.Join(outDir, "content", shard), 0o755); err != nil {
+			return err
+		}
+	}
+	return os.MkdirAll(filepath.Join(outDir, "date"), 0o755)
+}
+
+// writeOutput places encoded WebP bytes under outDir according to layout
+// and returns the path workers should report as the job's output.
+//
+// layout "flat" (the default) writes directly to outDir/<baseName>.webp,
+// disambiguating collisions the way the tool always has.
+//
+// layout "content" writes to content/<xx>/<sha256>.webp, where <xx> is the
+// first byte of the output's SHA-256, and symlinks
+// date/YYYY/MM/DD/<baseName>.webp to it. If dedup is set and the content
+// path already exists, the write is skipped and only the symlink is
+// (re)created, giving free dedup across runs.
+func writeOutput(outDir, layout string, dedup bool, baseName string, encoded []byte) (string, error) {
+	if layout != "content" {
+		outPath := uniquePath(filepath.Join(outDir, baseName+".webp"))
+		if err := os.WriteFile(outPath, encoded, 0o644); err != nil {
+			return "", err
+		}
+		return outPath, nil
+	}
+
+	sum := sha256.Sum256(encoded)
+	hexSum := hex.EncodeToString(sum[:])
+	contentPath := filepath.Join(outDir, "content", hexSum[:2], hexSum+".webp")
+
+	if !(dedup && fileExists(contentPath)) {
+		if err := os.WriteFile(contentPath, encoded, 0o644); err != nil {
+			return "", fmt.Errorf("write %s: %v", contentPath, err)
+		}
+	}
+
+	now := time.Now()
+	dateDir := filepath.Join(outDir, "date", now.Format("2006"), now.Format("01"), now.Format("02"))
+	if err := os.MkdirAll(dateDir, 0o755); err != nil {
+		return "", err
+	}
+	linkPath := uniquePath(filepath.Join(dateDir, baseName+".webp"))
+	rel, err := filepath.Rel(filepath.Dir(linkPath), contentPath)
+	if err != nil {
+		rel = contentPath
+	}
+	if err := os.Symlink(rel, linkPath); err != nil {
+		return "", fmt.Errorf("symlink %s: %v", linkPath, err)
+	}
+
+	return contentPath, nil
+}
+
+func fileExists(p string) bool {
+	_, err := os.Stat(p)
+	return err == nil
+}
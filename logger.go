@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+// newLogger opens <outDir>/webp.log and returns a level-filtered zerolog
+// logger that writes one record per job, plus the underlying file so the
+// caller can close it. format selects "json" (one JSON object per line,
+// suitable for CI post-processing) or "console" (human-readable).
+func newLogger(outDir, level, format string) (zerolog.Logger, *os.File, error) {
+	logFile, err := os.Create(filepath.Join(outDir, "webp.log"))
+	if err != nil {
+		return zerolog.Logger{}, nil, err
+	}
+
+	lvl, err := zerolog.ParseLevel(strings.ToLower(level))
+	if err != nil {
+		logFile.Close()
+		return zerolog.Logger{}, nil, fmt.Errorf("invalid --log-level %q: %v", level, err)
+	}
+
+	var w io.Writer = logFile
+	if format == "console" {
+		w = zerolog.ConsoleWriter{Out: logFile, TimeFormat: time.RFC3339, NoColor: true}
+	}
+
+	logger := zerolog.New(w).Level(lvl).With().Timestamp().Logger()
+	return logger, logFile, nil
+}
+
+// jobResult captures everything worth recording about a single conversion,
+// success or failure, for the structured log.
+type jobResult struct {
+	Source      string
+	Format      string
+	Width       int
+	Height      int
+	OutputPath  string
+	InputBytes  int
+	OutputBytes int
+	ElapsedMS   int64
+	Err         error
+}
+
+// log emits one record for a completed job: info on success, error on
+// failure, both through the same logger so the two cases end up in the
+// same stream for post-processing.
+func (r jobResult) log(logger zerolog.Logger) {
+	var ratio float64
+	if r.InputBytes > 0 {
+		ratio = float64(r.OutputBytes) / float64(r.InputBytes)
+	}
+
+	event := logger.Info()
+	if r.Err != nil {
+		event = logger.Error().Err(r.Err)
+	}
+
+	event.
+		Str("source", r.Source).
+		Str("format", r.Format).
+		Int("width", r.Width).
+		Int("height", r.Height).
+		Str("output", r.OutputPath).
+		Int("input_bytes", r.InputBytes).
+		Int("output_bytes", r.OutputBytes).
+		Float64("compression_ratio", ratio).
+		Int64("elapsed_ms", r.ElapsedMS).
+		Msg("convert")
+}
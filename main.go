@@ -1,14 +1,14 @@
 package main
 
 import (
+	"bytes"
 	"errors"
 	"flag"
 	"fmt"
-	"image"
 	_ "image/gif"
 	_ "image/jpeg"
 	_ "image/png"
-	"log"
+	"io"
 	"net/http"
 	"os"
 	"path"
@@ -19,8 +19,8 @@ import (
 	"sync"
 	"time"
 
+	"github.com/cheggaaa/pb/v3"
 	"github.com/chai2010/webp"
-	"github.com/schollz/progressbar/v3"
 )
 
 type Job struct {
@@ -29,6 +29,18 @@ type Job struct {
 	IsURL     bool
 }
 
+// jobOptions bundles the per-conversion settings that used to be threaded
+// through processFileJob/processURLJob as individual parameters; it grew
+// too large for that once the cache and progress reporting joined quality/
+// lossless/layout/dedup.
+type jobOptions struct {
+	Quality  int
+	Lossless bool
+	Layout   string
+	Dedup    bool
+	Cache    *cache
+}
+
 func main() {
 	// ---- CLI flags ----
 	dirFlag := flag.String("dir", "", "Path to local directory containing images")
@@ -37,10 +49,55 @@ func main() {
 	workersFlag := flag.Int("workers", 8, "Number of concurrent workers")
 	losslessFlag := flag.Bool("lossless", false, "Use lossless compression (better for PNGs)")
 	recursiveFlag := flag.Bool("recursive", false, "Scan all subdirectories when using --dir")
+	logLevelFlag := flag.String("log-level", "info", "Log level (debug|info|warn|error)")
+	logFormatFlag := flag.String("log-format", "json", "Log output format (json|console)")
+	layoutFlag := flag.String("layout", "flat", "Output layout: flat|content")
+	dedupFlag := flag.Bool("dedup", false, "Skip writing output whose content hash already exists (layout=content only)")
+	cacheDirFlag := flag.String("cache-dir", "", "Conversion cache directory (default ~/.cache/img-opt)")
+	cacheMaxAgeFlag := flag.Int("cache-max-age", -1, "Cache entry max age in seconds (-1 forever, 0 disables the cache)")
+	noCacheFlag := flag.Bool("no-cache", false, "Disable the conversion cache")
+	serveFlag := flag.String("serve", "", "Start an HTTP conversion server on this address (e.g. :8080) instead of running the CLI")
+	maxBodyFlag := flag.Int64("max-body", 25<<20, "Max request/response body size in bytes for --serve")
+	allowHostsFlag := flag.String("allow-hosts", "", "Regex allowlist for --serve's ?url= host (required to enable ?url=; unset disables it)")
+	timeoutFlag := flag.Duration("timeout", 30*time.Second, "Request timeout for --serve")
 	helpFlag := flag.Bool("help", false, "Show usage")
 
 	flag.Parse()
 
+	if *serveFlag != "" {
+		cacheMaxAge := *cacheMaxAgeFlag
+		if *noCacheFlag {
+			cacheMaxAge = 0
+		}
+		cch, err := newCache(*cacheDirFlag, cacheMaxAge)
+		if err != nil {
+			fmt.Println("Error preparing conversion cache:", err)
+			return
+		}
+
+		var allowHosts *regexp.Regexp
+		if *allowHostsFlag != "" {
+			allowHosts, err = regexp.Compile(*allowHostsFlag)
+			if err != nil {
+				fmt.Println("Invalid --allow-hosts pattern:", err)
+				return
+			}
+		}
+
+		err = runServer(*serveFlag, serverOptions{
+			Cache:      cch,
+			Quality:    *qualityFlag,
+			Lossless:   *losslessFlag,
+			MaxBody:    *maxBodyFlag,
+			AllowHosts: allowHosts,
+			Timeout:    *timeoutFlag,
+		})
+		if err != nil {
+			fmt.Println("Server error:", err)
+		}
+		return
+	}
+
 	if *helpFlag || (*dirFlag == "" && *urlsFlag == "") {
 		fmt.Println(`
 WebP CLI Converter
@@ -58,6 +115,17 @@ Options:
   --workers     Number of concurrent workers (default 8)
   --lossless    Use lossless compression (good for PNGs)
   --recursive   Scan all subdirectories (when using --dir)
+  --log-level   Log level: debug|info|warn|error (default info)
+  --log-format  Log output format: json|console (default json)
+  --layout      Output layout: flat|content (default flat)
+  --dedup       Skip writing output whose content hash exists (layout=content)
+  --cache-dir   Conversion cache directory (default ~/.cache/img-opt)
+  --cache-max-age  Cache entry max age in seconds (-1 forever, 0 disables)
+  --no-cache    Disable the conversion cache
+  --serve       Start an HTTP conversion server (e.g. --serve :8080)
+  --max-body    Max request/response body size in bytes for --serve
+  --allow-hosts Regex allowlist for --serve's ?url= host (required to enable ?url=)
+  --timeout     Request timeout for --serve (default 30s)
   --help        Show this help message
 `)
 		return
@@ -69,180 +137,285 @@ Options:
 		return
 	}
 
-	logFile, err := os.Create(filepath.Join(outDir, "webp-errors.log"))
-	if err != nil {
-		fmt.Println("Failed to create error log file:", err)
+	if err := prepareOutputDirs(outDir, *layoutFlag); err != nil {
+		fmt.Println("Error preparing output layout:", err)
 		return
 	}
-	defer logFile.Close()
-	logger := log.New(logFile, "", log.LstdFlags)
 
-	var jobs []Job
+	cacheMaxAge := *cacheMaxAgeFlag
+	if *noCacheFlag {
+		cacheMaxAge = 0
+	}
+	cch, err := newCache(*cacheDirFlag, cacheMaxAge)
+	if err != nil {
+		fmt.Println("Error preparing conversion cache:", err)
+		return
+	}
 
-	// ---- Load jobs from directory ----
-	if *dirFlag != "" {
-		files, err := collectLocalFiles(*dirFlag, *recursiveFlag)
-		if err != nil {
-			fmt.Println("Error reading directory:", err)
-			return
-		}
-		for _, f := range files {
-			jobs = append(jobs, Job{InputPath: f})
-		}
+	logger, logFile, err := newLogger(outDir, *logLevelFlag, *logFormatFlag)
+	if err != nil {
+		fmt.Println("Failed to create log file:", err)
+		return
 	}
+	defer logFile.Close()
 
-	// ---- Load jobs from URLs ----
+	var urlList []string
 	if *urlsFlag != "" {
-		urlList := strings.Split(*urlsFlag, ",")
-		for _, u := range urlList {
+		for _, u := range strings.Split(*urlsFlag, ",") {
 			u = strings.TrimSpace(u)
 			if u != "" {
-				jobs = append(jobs, Job{URL: u, IsURL: true})
+				urlList = append(urlList, u)
 			}
 		}
 	}
 
-	if len(jobs) == 0 {
+	if *dirFlag == "" && len(urlList) == 0 {
 		fmt.Println("No valid images found.")
 		return
 	}
 
-	fmt.Printf("Found %d image(s). Starting concurrent conversion...\n", len(jobs))
-	bar := progressbar.Default(int64(len(jobs)), "Converting")
+	jobChan, countChan, walkErrc := streamJobs(*dirFlag, *recursiveFlag, urlList)
+
+	opts := jobOptions{
+		Quality:  *qualityFlag,
+		Lossless: *losslessFlag,
+		Layout:   *layoutFlag,
+		Dedup:    *dedupFlag,
+		Cache:    cch,
+	}
+
+	workerProgresses := make([]*workerProgress, *workersFlag)
+	poolBars := make([]*pb.ProgressBar, 0, *workersFlag+1)
+	for i := range workerProgresses {
+		workerProgresses[i] = newWorkerProgress(i + 1)
+		poolBars = append(poolBars, workerProgresses[i].bar)
+	}
+	totalBar := pb.New(0)
+	totalBar.Set("prefix", "Total: ")
+	poolBars = append(poolBars, totalBar)
+
+	pool, err := pb.StartPool(poolBars...)
+	if err != nil {
+		fmt.Println("Error starting progress pool:", err)
+		return
+	}
+
+	go func() {
+		total, ok := <-countChan
+		if !ok {
+			return
+		}
+		totalBar.SetTotal(int64(total))
+	}()
 
 	var converted, failed int
 	var mu sync.Mutex
-	jobChan := make(chan Job)
 	var wg sync.WaitGroup
 
 	for i := 0; i < *workersFlag; i++ {
 		wg.Add(1)
-		go func() {
+		go func(wp *workerProgress) {
 			defer wg.Done()
 			for job := range jobChan {
-				var err error
+				var res jobResult
 				if job.IsURL {
-					err = processURLJob(job.URL, outDir, *qualityFlag, *losslessFlag)
+					res = processURLJob(job.URL, outDir, opts, wp)
 				} else {
-					err = processFileJob(job.InputPath, outDir, *qualityFlag, *losslessFlag)
+					res = processFileJob(job.InputPath, outDir, opts, wp)
 				}
+				res.log(logger)
+				wp.done()
 
-				if err != nil {
-					logger.Println(err)
-					mu.Lock()
+				mu.Lock()
+				if res.Err != nil {
 					failed++
-					mu.Unlock()
 				} else {
-					mu.Lock()
 					converted++
-					mu.Unlock()
 				}
-				bar.Add(1)
+				mu.Unlock()
+				totalBar.Increment()
 			}
-		}()
+		}(workerProgresses[i])
 	}
 
-	for _, job := range jobs {
-		jobChan <- job
-	}
-	close(jobChan)
 	wg.Wait()
+	pool.Stop()
+
+	if err := <-walkErrc; err != nil {
+		fmt.Println("Error scanning directory:", err)
+	}
 
 	fmt.Printf("\nDone. Converted: %d, Failed: %d. Output: %s\n", converted, failed, outDir)
-	fmt.Println("Error log:", filepath.Join(outDir, "webp-errors.log"))
+	fmt.Println("Log:", filepath.Join(outDir, "webp.log"))
 }
 
-func processFileJob(inputPath, outDir string, quality int, lossless bool) error {
-	imgFile, err := os.Open(inputPath)
+func processFileJob(inputPath, outDir string, opts jobOptions, wp *workerProgress) jobResult {
+	start := time.Now()
+	res := jobResult{Source: inputPath}
+	base := strings.TrimSuffix(filepath.Base(inputPath), filepath.Ext(inputPath))
+
+	wp.startEncoding(filepath.Base(inputPath))
+
+	data, err := os.ReadFile(inputPath)
 	if err != nil {
-		return fmt.Errorf("open file %s: %v", inputPath, err)
+		res.Err = fmt.Errorf("open file %s: %v", inputPath, err)
+		return res
 	}
-	defer imgFile.Close()
+	res.InputBytes = len(data)
+
+	format := sniffFormat(headerOf(data))
+	cacheKey := opts.Cache.key(data, opts.Quality, opts.Lossless, format)
+	encoded, hit := opts.Cache.get(cacheKey)
+	if hit {
+		res.Format = format
+		res.Width, res.Height, _ = sniffDimensions(format, data)
+	} else {
+		decoded, err := decodeAll(data)
+		if err != nil {
+			res.Err = fmt.Errorf("%s: %v", inputPath, err)
+			return res
+		}
+		res.Format = decoded.Format
+		b := decoded.Frames[0].Bounds()
+		res.Width, res.Height = b.Dx(), b.Dy()
 
-	img, format, err := image.Decode(imgFile)
-	if err != nil {
-		return fmt.Errorf("decode %s: %v", inputPath, err)
+		encoded, err = encodeWebPBytes(decoded, opts.Quality, opts.Lossless)
+		if err != nil {
+			res.Err = fmt.Errorf("encode %s: %v", inputPath, err)
+			return res
+		}
+		opts.Cache.put(cacheKey, encoded)
 	}
+	res.OutputBytes = len(encoded)
 
-	base := strings.TrimSuffix(filepath.Base(inputPath), filepath.Ext(inputPath))
-	outPath := uniquePath(filepath.Join(outDir, base+".webp"))
-	return encodeWebPImage(img, outPath, quality, lossless, format)
+	res.OutputPath, err = writeOutput(outDir, opts.Layout, opts.Dedup, base, encoded)
+	res.Err = err
+	res.ElapsedMS = time.Since(start).Milliseconds()
+	return res
 }
 
-func processURLJob(u, outDir string, quality int, lossless bool) error {
-	resp, err := http.Get(u)
+func processURLJob(u, outDir string, opts jobOptions, wp *workerProgress) jobResult {
+	start := time.Now()
+	res := jobResult{Source: u}
+
+	name := path.Base(u)
+	name = sanitizeFileName(strings.TrimSuffix(name, filepath.Ext(name)))
+
+	prevMeta, hadMeta := opts.Cache.loadURLMeta(u)
+
+	req, err := http.NewRequest(http.MethodGet, u, nil)
 	if err != nil {
-		return fmt.Errorf("download %s: %v", u, err)
+		res.Err = fmt.Errorf("download %s: %v", u, err)
+		return res
 	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode < 200 || resp.StatusCode > 299 {
-		return fmt.Errorf("invalid response %s: %s", u, resp.Status)
+	if hadMeta {
+		if prevMeta.ETag != "" {
+			req.Header.Set("If-None-Match", prevMeta.ETag)
+		}
+		if prevMeta.LastModified != "" {
+			req.Header.Set("If-Modified-Since", prevMeta.LastModified)
+		}
 	}
 
-	img, format, err := image.Decode(resp.Body)
+	wp.startDownload(name, 0)
+	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
-		return fmt.Errorf("decode %s: %v", u, err)
+		res.Err = fmt.Errorf("download %s: %v", u, err)
+		return res
 	}
+	defer resp.Body.Close()
 
-	name := path.Base(u)
-	name = sanitizeFileName(strings.TrimSuffix(name, filepath.Ext(name)))
-	outPath := uniquePath(filepath.Join(outDir, name+".webp"))
-	return encodeWebPImage(img, outPath, quality, lossless, format)
-}
+	if resp.StatusCode == http.StatusNotModified {
+		if encoded, hit := opts.Cache.get(prevMeta.ContentKey); hit {
+			wp.startEncoding(name)
+			res.OutputBytes = len(encoded)
+			res.OutputPath, err = writeOutput(outDir, opts.Layout, opts.Dedup, name, encoded)
+			res.Err = err
+			res.ElapsedMS = time.Since(start).Milliseconds()
+			return res
+		}
+		// Remote says unchanged but our copy of the encoded bytes is gone;
+		// fall through to a normal conditional-free fetch.
+		resp.Body.Close()
+		resp, err = http.Get(u)
+		if err != nil {
+			res.Err = fmt.Errorf("download %s: %v", u, err)
+			return res
+		}
+		defer resp.Body.Close()
+	}
 
-func encodeWebPImage(img image.Image, outputPath string, quality int, lossless bool, format string) error {
-	if err := os.MkdirAll(filepath.Dir(outputPath), 0o755); err != nil {
-		return err
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		res.Err = fmt.Errorf("invalid response %s: %s", u, resp.Status)
+		return res
 	}
 
-	out, err := os.Create(outputPath)
+	wp.startDownload(name, resp.ContentLength)
+	body := &countingReader{r: resp.Body, bar: wp.bar}
+	data, err := io.ReadAll(body)
 	if err != nil {
-		return err
+		res.Err = fmt.Errorf("download %s: %v", u, err)
+		return res
+	}
+	res.InputBytes = len(data)
+
+	wp.startEncoding(name)
+	format := sniffFormat(headerOf(data))
+	cacheKey := opts.Cache.key(data, opts.Quality, opts.Lossless, format)
+	encoded, hit := opts.Cache.get(cacheKey)
+	if hit {
+		res.Format = format
+		res.Width, res.Height, _ = sniffDimensions(format, data)
+	} else {
+		decoded, err := decodeAll(data)
+		if err != nil {
+			res.Err = fmt.Errorf("%s: %v", u, err)
+			return res
+		}
+		res.Format = decoded.Format
+		b := decoded.Frames[0].Bounds()
+		res.Width, res.Height = b.Dx(), b.Dy()
+
+		encoded, err = encodeWebPBytes(decoded, opts.Quality, opts.Lossless)
+		if err != nil {
+			res.Err = fmt.Errorf("encode %s: %v", u, err)
+			return res
+		}
+		opts.Cache.put(cacheKey, encoded)
 	}
-	defer out.Close()
+	res.OutputBytes = len(encoded)
+
+	opts.Cache.saveURLMeta(u, urlMeta{
+		ETag:         resp.Header.Get("ETag"),
+		LastModified: resp.Header.Get("Last-Modified"),
+		ContentKey:   cacheKey,
+	})
+
+	res.OutputPath, err = writeOutput(outDir, opts.Layout, opts.Dedup, name, encoded)
+	res.Err = err
+	res.ElapsedMS = time.Since(start).Milliseconds()
+	return res
+}
+
+// encodeWebPBytes encodes decoded to WebP in memory, producing an animated
+// WebP when decoded has more than one frame.
+func encodeWebPBytes(decoded *decodedImage, quality int, lossless bool) ([]byte, error) {
+	var buf bytes.Buffer
 
 	// PNG → lossless by default
 	opts := &webp.Options{Quality: float32(quality)}
-	if lossless || strings.EqualFold(format, "png") {
+	if lossless || strings.EqualFold(decoded.Format, "png") {
 		opts.Lossless = true
 	}
 
-	if err := webp.Encode(out, img, opts); err != nil {
-		return fmt.Errorf("encode %s: %v", outputPath, err)
+	if len(decoded.Frames) > 1 {
+		return encodeAnimatedWebP(decoded, quality, opts.Lossless)
 	}
-	return nil
-}
 
-func collectLocalFiles(folder string, recursive bool) ([]string, error) {
-	abs, err := filepath.Abs(folder)
-	if err != nil {
+	if err := webp.Encode(&buf, decoded.Frames[0], opts); err != nil {
 		return nil, err
 	}
-
-	var files []string
-	if recursive {
-		err = filepath.WalkDir(abs, func(p string, d os.DirEntry, err error) error {
-			if err != nil {
-				return err
-			}
-			if !d.IsDir() && isImageExt(p) {
-				files = append(files, p)
-			}
-			return nil
-		})
-	} else {
-		entries, err := os.ReadDir(abs)
-		if err != nil {
-			return nil, err
-		}
-		for _, e := range entries {
-			if !e.IsDir() && isImageExt(e.Name()) {
-				files = append(files, filepath.Join(abs, e.Name()))
-			}
-		}
-	}
-	return files, err
+	return buf.Bytes(), nil
 }
 
 func createOutputFolder() (string, error) {
@@ -271,9 +444,18 @@ func downloadsDir() (string, error) {
 	return cwd, nil
 }
 
+// isImageExt is a fast pre-filter for directory walks; it trades a few
+// false negatives (images with an unexpected or missing extension) for
+// avoiding a sniff read on every directory entry. Anything that reaches
+// processFileJob/processURLJob is still routed by decodeAll's magic-number
+// sniff regardless of what this returns.
 func isImageExt(p string) bool {
-	ext := strings.ToLower(filepath.Ext(p))
-	return ext == ".png" || ext == ".jpg" || ext == ".jpeg"
+	switch strings.ToLower(filepath.Ext(p)) {
+	case ".png", ".jpg", ".jpeg", ".gif", ".webp", ".heic", ".heif", ".avif", ".tiff", ".tif", ".bmp":
+		return true
+	default:
+		return false
+	}
 }
 
 func uniquePath(p string) string {
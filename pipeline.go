@@ -0,0 +1,64 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// streamJobs starts a goroutine that streams every job onto the returned
+// channel as soon as it's found: URL jobs immediately, directory entries as
+// filepath.WalkDir discovers them. This keeps peak memory bounded
+// regardless of how many files are under dir and lets workers start
+// converting before the scan finishes, instead of materializing the full
+// job list up front. Once the walk is done, the count channel receives the
+// final number of jobs produced and then the job channel closes.
+func streamJobs(dir string, recursive bool, urls []string) (<-chan Job, <-chan int, <-chan error) {
+	jobs := make(chan Job, 64)
+	count := make(chan int, 1)
+	errc := make(chan error, 1)
+
+	go func() {
+		defer close(jobs)
+		defer close(errc)
+		defer close(count)
+
+		n := 0
+		for _, u := range urls {
+			jobs <- Job{URL: u, IsURL: true}
+			n++
+		}
+
+		if dir != "" {
+			abs, err := filepath.Abs(dir)
+			if err != nil {
+				errc <- err
+				count <- n
+				return
+			}
+
+			walkErr := filepath.WalkDir(abs, func(p string, d os.DirEntry, err error) error {
+				if err != nil {
+					return err
+				}
+				if d.IsDir() {
+					if p != abs && !recursive {
+						return filepath.SkipDir
+					}
+					return nil
+				}
+				if isImageExt(p) {
+					jobs <- Job{InputPath: p}
+					n++
+				}
+				return nil
+			})
+			if walkErr != nil {
+				errc <- walkErr
+			}
+		}
+
+		count <- n
+	}()
+
+	return jobs, count, errc
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/cheggaaa/pb/v3"
+)
+
+// workerProgress is one worker's row in the multi-bar pool: a byte counter
+// while downloading a URL job (relabeled to "encoding" once the fetch
+// finishes), or just the current file name and an "encoding" label for
+// local jobs. This makes network stalls and CPU-bound encoding stalls
+// visibly distinct instead of both hiding behind a single spinner.
+type workerProgress struct {
+	bar *pb.ProgressBar
+}
+
+func newWorkerProgress(id int) *workerProgress {
+	tmpl := fmt.Sprintf(`worker %d: {{string . "state" | rndcolor}} {{string . "name"}} {{counters . }} {{bar . }} {{percent . }}`, id)
+	bar := pb.ProgressBarTemplate(tmpl).New(0)
+	bar.Set("state", "idle")
+	bar.Set("name", "-")
+	return &workerProgress{bar: bar}
+}
+
+// startDownload switches the bar into byte-level download mode with the
+// given total (0 when the server didn't send Content-Length). total arrives
+// as -1, not 0, for an unknown http.Response.ContentLength, so that's
+// normalized here rather than trusted from the caller.
+func (w *workerProgress) startDownload(name string, total int64) {
+	if total < 0 {
+		total = 0
+	}
+	w.bar.SetCurrent(0)
+	w.bar.SetTotal(total)
+	w.bar.Set("state", "downloading")
+	w.bar.Set("name", name)
+}
+
+// startEncoding relabels the bar once the source bytes are in hand,
+// whether they came from a finished download or a local file read.
+func (w *workerProgress) startEncoding(name string) {
+	w.bar.Set("state", "encoding")
+	w.bar.Set("name", name)
+}
+
+// done resets the bar between jobs.
+func (w *workerProgress) done() {
+	w.bar.Set("state", "idle")
+	w.bar.Set("name", "-")
+}
+
+// countingReader wraps a response body and ticks a worker's bar as bytes
+// arrive, the same pattern Docker's image-pull progress reader uses.
+type countingReader struct {
+	r   io.Reader
+	bar *pb.ProgressBar
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	if n > 0 {
+		c.bar.Add(n)
+	}
+	return n, err
+}
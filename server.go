@@ -0,0 +1,250 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// serverOptions configures the long-running HTTP conversion service started
+// by --serve. It reuses the same cache and encode settings as the CLI path,
+// so a cache warmed by one serves the other.
+type serverOptions struct {
+	Cache      *cache
+	Quality    int
+	Lossless   bool
+	MaxBody    int64
+	AllowHosts *regexp.Regexp
+	Timeout    time.Duration
+}
+
+// runServer starts the HTTP conversion service and blocks until it exits.
+func runServer(addr string, opts serverOptions) error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/convert", func(w http.ResponseWriter, r *http.Request) {
+		handleConvert(w, r, opts)
+	})
+
+	srv := &http.Server{
+		Addr:         addr,
+		Handler:      mux,
+		ReadTimeout:  opts.Timeout,
+		WriteTimeout: opts.Timeout,
+	}
+	fmt.Println("Serving WebP conversions on", addr)
+	return srv.ListenAndServe()
+}
+
+// handleConvert backs both POST /convert (multipart upload) and
+// GET /convert?url=... (proxy-and-convert), negotiating on Accept: image/webp
+// when the client supports it, the original bytes otherwise. There is no
+// AVIF encode path (decodeAll can read AVIF sources, but nothing in this
+// binary writes them), so an Accept: image/avif client is treated the same
+// as one that doesn't support WebP and gets the original bytes back.
+func handleConvert(w http.ResponseWriter, r *http.Request, opts serverOptions) {
+	var data []byte
+	var err error
+
+	switch r.Method {
+	case http.MethodPost:
+		data, err = readUploadedImage(r, opts.MaxBody)
+	case http.MethodGet:
+		data, err = fetchRemoteImage(r, opts)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	decoded, err := decodeAll(data)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("decode: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	if !acceptsWebP(r.Header.Get("Accept")) {
+		w.Header().Set("Content-Type", mimeForFormat(decoded.Format))
+		w.Write(data)
+		return
+	}
+
+	cacheKey := opts.Cache.key(data, opts.Quality, opts.Lossless, decoded.Format)
+	encoded, hit := opts.Cache.get(cacheKey)
+	if !hit {
+		encoded, err = encodeWebPBytes(decoded, opts.Quality, opts.Lossless)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("encode: %v", err), http.StatusInternalServerError)
+			return
+		}
+		opts.Cache.put(cacheKey, encoded)
+	}
+
+	w.Header().Set("Content-Type", "image/webp")
+	w.Write(encoded)
+}
+
+func readUploadedImage(r *http.Request, maxBody int64) ([]byte, error) {
+	r.Body = http.MaxBytesReader(nil, r.Body, maxBody)
+	if err := r.ParseMultipartForm(maxBody); err != nil {
+		return nil, fmt.Errorf("parse upload: %v", err)
+	}
+	file, _, err := r.FormFile("image")
+	if err != nil {
+		return nil, fmt.Errorf("missing \"image\" field: %v", err)
+	}
+	defer file.Close()
+	return io.ReadAll(file)
+}
+
+// fetchRemoteImage proxies a remote image for GET /convert?url=. This is an
+// SSRF-sensitive path: the server is expected to sit behind a CDN and fetch
+// whatever URL a client hands it, so it must never be usable to reach a
+// caller's internal network. AllowHosts is required (not just an optional
+// filter), every hop a redirect takes is re-validated against the same
+// scheme/allowlist policy, and the actual TCP connection is pinned to the
+// specific IP that was validated (see dialValidated) so a second,
+// independent DNS resolution inside the dialer can't answer a DNS-rebinding
+// attack differently than the check did.
+func fetchRemoteImage(r *http.Request, opts serverOptions) ([]byte, error) {
+	raw := r.URL.Query().Get("url")
+	if raw == "" {
+		return nil, fmt.Errorf("missing url parameter")
+	}
+	target, err := url.Parse(raw)
+	if err != nil {
+		return nil, fmt.Errorf("invalid url: %v", err)
+	}
+	if opts.AllowHosts == nil {
+		return nil, fmt.Errorf("remote fetch is disabled: start with --allow-hosts to enable ?url=")
+	}
+	if err := checkFetchAllowed(target, opts.AllowHosts); err != nil {
+		return nil, err
+	}
+
+	client := &http.Client{
+		Timeout:   opts.Timeout,
+		Transport: &http.Transport{DialContext: dialValidated},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= 10 {
+				return fmt.Errorf("stopped after 10 redirects")
+			}
+			return checkFetchAllowed(req.URL, opts.AllowHosts)
+		},
+	}
+	resp, err := client.Get(target.String())
+	if err != nil {
+		return nil, fmt.Errorf("fetch %s: %v", target, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, fmt.Errorf("fetch %s: %s", target, resp.Status)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, opts.MaxBody))
+}
+
+// checkFetchAllowed applies the hostname-based policy (scheme, allowlist) to
+// a URL; it's run both on the initial target and on every redirect hop.
+func checkFetchAllowed(target *url.URL, allowHosts *regexp.Regexp) error {
+	if target.Scheme != "http" && target.Scheme != "https" {
+		return fmt.Errorf("unsupported url scheme %q", target.Scheme)
+	}
+	if !allowHosts.MatchString(target.Host) {
+		return fmt.Errorf("host %q is not allowlisted", target.Host)
+	}
+	return nil
+}
+
+// dialValidated is the Transport.DialContext for ssrf-sensitive fetches. It
+// resolves the host itself, rejects any private/loopback/link-local/
+// unspecified address, and dials the specific IP it just validated — doing
+// the resolution and the connection against the same answer closes the gap
+// a plain http.Client has, where the dialer's own independent resolution can
+// return something different than whatever check ran first.
+func dialValidated(ctx context.Context, network, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	ips, err := net.DefaultResolver.LookupIP(ctx, "ip", host)
+	if err != nil {
+		return nil, fmt.Errorf("resolve %s: %v", host, err)
+	}
+
+	var dialer net.Dialer
+	var lastErr error
+	for _, ip := range ips {
+		if isNonRoutable(ip) {
+			lastErr = fmt.Errorf("host %q resolves to a non-routable address %s", host, ip)
+			continue
+		}
+		conn, err := dialer.DialContext(ctx, network, net.JoinHostPort(ip.String(), port))
+		if err == nil {
+			return conn, nil
+		}
+		lastErr = err
+	}
+	if lastErr == nil {
+		lastErr = fmt.Errorf("no addresses found for %s", host)
+	}
+	return nil, lastErr
+}
+
+// isNonRoutable reports whether ip falls in a private, loopback, link-local,
+// or unspecified range — the ranges an SSRF-sensitive fetch must never
+// reach regardless of what hostname resolved to it.
+func isNonRoutable(ip net.IP) bool {
+	return ip.IsPrivate() || ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsUnspecified()
+}
+
+// acceptsWebP reports whether the client's Accept header includes
+// image/webp or a wildcard that covers it; an empty or absent Accept header
+// counts as accepting WebP. It does not special-case
+// image/avif: there's no AVIF encoder wired in, so an AVIF-only Accept
+// header falls through to the original-bytes response like any other
+// unsupported type.
+func acceptsWebP(accept string) bool {
+	if accept == "" {
+		return true
+	}
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, _, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		if mediaType == "image/webp" || mediaType == "image/*" || mediaType == "*/*" {
+			return true
+		}
+	}
+	return false
+}
+
+func mimeForFormat(format string) string {
+	switch format {
+	case "jpeg":
+		return "image/jpeg"
+	case "png":
+		return "image/png"
+	case "gif":
+		return "image/gif"
+	case "bmp":
+		return "image/bmp"
+	case "tiff":
+		return "image/tiff"
+	case "heic":
+		return "image/heic"
+	case "avif":
+		return "image/avif"
+	default:
+		return "application/octet-stream"
+	}
+}